@@ -0,0 +1,252 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_pd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/mount"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/volume"
+	"github.com/golang/glog"
+)
+
+// attachFunc performs the actual EC2 AttachVolume call (and subsequent
+// format/mount) for a PD; detachFunc performs the actual EC2 DetachVolume
+// call. Both are injected so attachDetachManager stays test-friendly and
+// doesn't need to know about AWSDiskUtil.
+type attachFunc func(pd *awsPersistentDisk, globalPDPath string) error
+type detachFunc func(pd *awsPersistentDisk) error
+
+// detachEnqueueTimeout bounds how long enqueueDetach waits for room on
+// detachCh before retrying that one request on a fresh goroutine.
+const detachEnqueueTimeout = 30 * time.Second
+
+// attachDetachManager reference-counts, per node, how many local mounts are
+// using each EBS volume. SetUpAt/TearDownAt only ever touch the refcount;
+// the real AttachVolume/DetachVolume calls happen here, with the detach
+// side performed on a background worker so a slow or racy detach never
+// blocks a pod's teardown.
+type attachDetachManager struct {
+	mu       sync.Mutex
+	refs     map[string]*pdRef
+	detachCh chan detachRequest
+}
+
+// pdRef tracks the local refcount for a pdName along with whether it was
+// attached read-only in multi-attach mode. That comes from the pd passed to
+// acquire (the Builder path, which has the full spec); the TearDownAt/Release
+// path runs through a Cleaner whose pd was only built from a volName/podUID,
+// so it never has readOnly/volumeType populated. Storing the computed flag
+// here, keyed by pdName, lets release() make the multi-attach decision off
+// the PD that was actually attached instead of an empty one. noAutoDetachMarker
+// mirrors this flag to disk so it also survives a kubelet restart, see
+// RebuildAttachDetachState.
+type pdRef struct {
+	count        int
+	noAutoDetach bool
+}
+
+type detachRequest struct {
+	pd     *awsPersistentDisk
+	detach detachFunc
+}
+
+// globalAttachDetachManager is the single attach/detach manager for this
+// kubelet process; all PDs on this node share its refcounts.
+var globalAttachDetachManager = newAttachDetachManager()
+
+func newAttachDetachManager() *attachDetachManager {
+	m := &attachDetachManager{
+		refs:     make(map[string]*pdRef),
+		detachCh: make(chan detachRequest, 32),
+	}
+	go m.detachWorker()
+	return m
+}
+
+// acquire attaches pd via attach if this is the first local reference to
+// pd.pdName, then increments the refcount. Safe to call concurrently. For a
+// read-only multi-attach PD, it also drops a marker file next to globalPDPath
+// so RebuildAttachDetachState can recover the "never auto-detach" flag after
+// a kubelet restart, when pd itself no longer carries readOnly/volumeType.
+func (m *attachDetachManager) acquire(pd *awsPersistentDisk, globalPDPath string, attach attachFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref, ok := m.refs[pd.pdName]
+	if !ok {
+		if err := attach(pd, globalPDPath); err != nil {
+			return err
+		}
+		noAutoDetach := pd.readOnly && isMultiAttachVolumeType(pd.volumeType)
+		if noAutoDetach {
+			if err := writeNoAutoDetachMarker(globalPDPath); err != nil {
+				glog.Warningf("Could not record no-auto-detach marker for %q, a kubelet restart may detach it prematurely: %v", pd.pdName, err)
+			}
+		}
+		ref = &pdRef{noAutoDetach: noAutoDetach}
+		m.refs[pd.pdName] = ref
+	}
+	ref.count++
+	return nil
+}
+
+// release decrements the refcount for pd.pdName. Once it reaches zero, the
+// actual detach is handed to the background worker rather than performed
+// inline, so release() itself never blocks the caller - it hands off to
+// enqueueDetach on its own goroutine even when detachCh is momentarily full.
+// Read-only multi-attach volumes are never queued for detach here: this
+// node has no way of knowing whether another node still holds a read-only
+// attachment, so that is left to a cluster-level attach/detach controller.
+// Whether pd is read-only multi-attach is read off the refcount entry
+// recorded at acquire time, not off pd itself, since pd here may come from a
+// Cleaner that never had readOnly/volumeType populated.
+func (m *attachDetachManager) release(pd *awsPersistentDisk, detach detachFunc) {
+	m.mu.Lock()
+	ref, ok := m.refs[pd.pdName]
+	if !ok {
+		m.mu.Unlock()
+		glog.Warningf("Release called for %q with no outstanding acquire, ignoring", pd.pdName)
+		return
+	}
+	ref.count--
+	if ref.count > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.refs, pd.pdName)
+	noAutoDetach := ref.noAutoDetach
+	m.mu.Unlock()
+
+	if noAutoDetach {
+		glog.V(4).Infof("Not detaching multi-attach PD %q; a future attach/detach controller will reconcile it", pd.pdName)
+		return
+	}
+
+	go m.enqueueDetach(detachRequest{pd: pd, detach: detach})
+}
+
+// enqueueDetach hands req to the background worker, blocking (with a bound)
+// rather than dropping it if the queue is momentarily full. It always runs
+// on its own goroutine (release never calls it directly) so a caller
+// tearing down a volume is never held up by a backed-up detach queue. If
+// the queue is still full after detachEnqueueTimeout, req is retried on a
+// fresh goroutine with the same bound instead of being discarded or
+// blocking forever: a request that loses that race simply tries again
+// rather than piling up unbounded goroutines.
+func (m *attachDetachManager) enqueueDetach(req detachRequest) {
+	select {
+	case m.detachCh <- req:
+		return
+	case <-time.After(detachEnqueueTimeout):
+	}
+	glog.Errorf("Detach queue still full after %s, retrying %q on a dedicated goroutine", detachEnqueueTimeout, req.pd.pdName)
+	go m.enqueueDetach(req)
+}
+
+// rebuild seeds refcounts, overwriting any ref already held for a given
+// pdName. Used once at kubelet startup; see RebuildAttachDetachState.
+func (m *attachDetachManager) rebuild(refs map[string]*pdRef) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pdName, ref := range refs {
+		m.refs[pdName] = ref
+	}
+}
+
+// detachWorker runs for the lifetime of the process, performing queued
+// detaches with exponential backoff so a transient EC2 error doesn't lose
+// the request.
+func (m *attachDetachManager) detachWorker() {
+	for req := range m.detachCh {
+		backoff := util.Backoff{Duration: time.Second, Factor: 2, Steps: 6}
+		err := util.ExponentialBackoff(backoff, func() (bool, error) {
+			if err := req.detach(req.pd); err != nil {
+				glog.Warningf("Error detaching PD %q, will retry: %v", req.pd.pdName, err)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			glog.Errorf("Giving up detaching PD %q: %v", req.pd.pdName, err)
+		}
+	}
+}
+
+// noAutoDetachMarkerSuffix names the sibling file acquire() drops next to a
+// read-only multi-attach PD's global mount directory, so RebuildAttachDetachState
+// can recover the "never auto-detach" flag after a kubelet restart, when the
+// in-memory pdRef it was tracked in is gone.
+const noAutoDetachMarkerSuffix = ".no-auto-detach"
+
+func writeNoAutoDetachMarker(globalPDPath string) error {
+	return ioutil.WriteFile(globalPDPath+noAutoDetachMarkerSuffix, []byte{}, 0644)
+}
+
+func hasNoAutoDetachMarker(globalPDPath string) bool {
+	_, err := os.Stat(globalPDPath + noAutoDetachMarkerSuffix)
+	return err == nil
+}
+
+// RebuildAttachDetachState seeds the global attach/detach manager's
+// refcounts from the bind mounts that already exist under host's plugin
+// directory. Call this once when the kubelet starts, so a restart doesn't
+// forget which PDs are still in use by running pods and detach out from
+// under them, and doesn't forget that a read-only multi-attach PD must never
+// be auto-detached either.
+func RebuildAttachDetachState(host volume.VolumeHost, mounter mount.Interface) error {
+	mountsDir := path.Join(host.GetPluginDir(awsPersistentDiskPluginName), "mounts")
+	entries, err := ioutil.ReadDir(mountsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	refs := make(map[string]*pdRef)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), noAutoDetachMarkerSuffix) {
+			continue
+		}
+		globalPDPath := path.Join(mountsDir, entry.Name())
+		pdName, err := getPdNameFromGlobalMount(host, globalPDPath)
+		if err != nil {
+			glog.Warningf("Could not determine PD name for %q, skipping: %v", globalPDPath, err)
+			continue
+		}
+		mountRefs, err := mount.GetMountRefs(mounter, globalPDPath)
+		if err != nil {
+			glog.Warningf("Could not list mount refs for %q, skipping: %v", globalPDPath, err)
+			continue
+		}
+		// GetMountRefs leaves out the global mount itself, so every ref is
+		// a per-pod bind mount that is still using it.
+		if count := len(mountRefs); count > 0 {
+			refs[pdName] = &pdRef{count: count, noAutoDetach: hasNoAutoDetachMarker(globalPDPath)}
+		}
+	}
+
+	globalAttachDetachManager.rebuild(refs)
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_pd
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAttachDetachManager() *attachDetachManager {
+	m := &attachDetachManager{
+		refs:     make(map[string]*pdRef),
+		detachCh: make(chan detachRequest, 32),
+	}
+	go m.detachWorker()
+	return m
+}
+
+func TestAcquireOnlyAttachesOnce(t *testing.T) {
+	m := newTestAttachDetachManager()
+	pd := &awsPersistentDisk{pdName: "vol-1"}
+	globalPDPath := t.TempDir() + "/vol-1"
+
+	attachCount := 0
+	attach := func(pd *awsPersistentDisk, globalPDPath string) error {
+		attachCount++
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.acquire(pd, globalPDPath, attach); err != nil {
+			t.Fatalf("acquire %d failed: %v", i, err)
+		}
+	}
+	if attachCount != 1 {
+		t.Errorf("expected attach to be called once, got %d", attachCount)
+	}
+	if m.refs["vol-1"].count != 3 {
+		t.Errorf("expected refcount 3, got %d", m.refs["vol-1"].count)
+	}
+}
+
+func TestReleaseDetachesOnLastReference(t *testing.T) {
+	m := newTestAttachDetachManager()
+	pd := &awsPersistentDisk{pdName: "vol-1"}
+	globalPDPath := t.TempDir() + "/vol-1"
+	attach := func(pd *awsPersistentDisk, globalPDPath string) error { return nil }
+
+	for i := 0; i < 2; i++ {
+		if err := m.acquire(pd, globalPDPath, attach); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+	}
+
+	detached := make(chan string, 1)
+	detach := func(pd *awsPersistentDisk) error {
+		detached <- pd.pdName
+		return nil
+	}
+
+	m.release(pd, detach)
+	select {
+	case <-detached:
+		t.Fatalf("detach should not run until the last reference is released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.release(pd, detach)
+	select {
+	case name := <-detached:
+		if name != "vol-1" {
+			t.Errorf("expected detach for vol-1, got %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected detach to run after the last reference was released")
+	}
+}
+
+// TestReleaseDoesNotDetachReadOnlyMultiAttach is a regression test for the
+// case where pd.readOnly/pd.volumeType come from a Cleaner's pd (never
+// populated) rather than the pd that was actually attached: the decision
+// must be made off the refcount entry recorded at acquire time.
+func TestReleaseDoesNotDetachReadOnlyMultiAttach(t *testing.T) {
+	m := newTestAttachDetachManager()
+	attached := &awsPersistentDisk{pdName: "vol-1", readOnly: true, volumeType: "io1"}
+	globalPDPath := t.TempDir() + "/vol-1"
+	attach := func(pd *awsPersistentDisk, globalPDPath string) error { return nil }
+	if err := m.acquire(attached, globalPDPath, attach); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	detached := make(chan string, 1)
+	detach := func(pd *awsPersistentDisk) error {
+		detached <- pd.pdName
+		return nil
+	}
+
+	// Simulate the Cleaner path: a pd with no readOnly/volumeType set.
+	cleanerPD := &awsPersistentDisk{pdName: "vol-1"}
+	m.release(cleanerPD, detach)
+
+	select {
+	case <-detached:
+		t.Fatalf("a read-only multi-attach volume must never be auto-detached")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestNoAutoDetachSurvivesRebuild is a regression test: rebuild() (the
+// kubelet-restart path) must not silently drop the "never auto-detach" flag
+// for a read-only multi-attach PD that is still referenced after a restart.
+func TestNoAutoDetachSurvivesRebuild(t *testing.T) {
+	m := newTestAttachDetachManager()
+	globalPDPath := t.TempDir() + "/vol-1"
+	attach := func(pd *awsPersistentDisk, globalPDPath string) error { return nil }
+	attached := &awsPersistentDisk{pdName: "vol-1", readOnly: true, volumeType: "io1"}
+	if err := m.acquire(attached, globalPDPath, attach); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if !hasNoAutoDetachMarker(globalPDPath) {
+		t.Fatalf("expected acquire to leave a no-auto-detach marker at %s", globalPDPath)
+	}
+
+	// Simulate a kubelet restart: a fresh manager, rebuilt purely from the
+	// marker file and refcount, with no acquire() call to seed it.
+	restarted := newTestAttachDetachManager()
+	restarted.rebuild(map[string]*pdRef{
+		"vol-1": {count: 1, noAutoDetach: hasNoAutoDetachMarker(globalPDPath)},
+	})
+
+	detached := make(chan string, 1)
+	detach := func(pd *awsPersistentDisk) error {
+		detached <- pd.pdName
+		return nil
+	}
+	restarted.release(&awsPersistentDisk{pdName: "vol-1"}, detach)
+
+	select {
+	case <-detached:
+		t.Fatalf("a read-only multi-attach volume must not be auto-detached after a restart")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReleaseWithoutAcquireIsIgnored(t *testing.T) {
+	m := newTestAttachDetachManager()
+	pd := &awsPersistentDisk{pdName: "vol-never-acquired"}
+	called := false
+	detach := func(pd *awsPersistentDisk) error {
+		called = true
+		return nil
+	}
+	m.release(pd, detach)
+	if called {
+		t.Errorf("detach should not be called for a pd with no outstanding acquire")
+	}
+}
+
+// TestReleaseDoesNotDropRequestsUnderBackpressure is a regression test: with
+// a tiny detachCh buffer and a slow consumer, every released pd must still
+// eventually be detached instead of being silently discarded the moment the
+// buffer fills up.
+func TestReleaseDoesNotDropRequestsUnderBackpressure(t *testing.T) {
+	m := &attachDetachManager{
+		refs:     make(map[string]*pdRef),
+		detachCh: make(chan detachRequest, 1),
+	}
+	tmpDir := t.TempDir()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		for req := range m.detachCh {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			seen[req.pd.pdName] = true
+			mu.Unlock()
+		}
+		close(done)
+	}()
+
+	attach := func(pd *awsPersistentDisk, globalPDPath string) error { return nil }
+	detach := func(pd *awsPersistentDisk) error { return nil }
+
+	names := []string{"vol-1", "vol-2", "vol-3", "vol-4", "vol-5"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			pd := &awsPersistentDisk{pdName: name}
+			if err := m.acquire(pd, tmpDir+"/"+name, attach); err != nil {
+				t.Errorf("acquire(%s) failed: %v", name, err)
+				return
+			}
+			m.release(pd, detach)
+		}(name)
+	}
+	wg.Wait()
+
+	// release() now hands off to enqueueDetach on its own goroutine, so the
+	// sends onto m.detachCh can still be in flight after release() returns;
+	// poll for them to land before tearing the channel down.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		allSeen := len(seen) == len(names)
+		mu.Unlock()
+		if allSeen || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(m.detachCh)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		if !seen[name] {
+			t.Errorf("detach request for %q was dropped instead of being retried", name)
+		}
+	}
+}
@@ -20,10 +20,12 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api/resource"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/cloudprovider"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/cloudprovider/aws"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
@@ -44,6 +46,8 @@ type awsPersistentDiskPlugin struct {
 }
 
 var _ volume.VolumePlugin = &awsPersistentDiskPlugin{}
+var _ volume.ProvisionableVolumePlugin = &awsPersistentDiskPlugin{}
+var _ volume.DeletableVolumePlugin = &awsPersistentDiskPlugin{}
 
 const (
 	awsPersistentDiskPluginName = "kubernetes.io/aws-pd"
@@ -64,10 +68,25 @@ func (plugin *awsPersistentDiskPlugin) CanSupport(spec *api.Volume) bool {
 	return false
 }
 
-func (plugin *awsPersistentDiskPlugin) GetAccessModes() []api.AccessModeType {
-	return []api.AccessModeType{
-		api.ReadWriteOnce,
+func (plugin *awsPersistentDiskPlugin) GetAccessModes(spec *api.Volume) []api.AccessModeType {
+	modes := []api.AccessModeType{api.ReadWriteOnce}
+	if spec != nil && spec.AWSPersistentDisk != nil && isMultiAttachVolumeType(spec.AWSPersistentDisk.VolumeType) {
+		// io1/io2 volumes can be attached read-only to more than one
+		// instance at once, so they can also satisfy ReadOnlyMany claims.
+		modes = append(modes, api.ReadOnlyMany)
 	}
+	return modes
+}
+
+// multiAttachVolumeTypes are the EBS volume types that support attaching a
+// single volume, read-only, to more than one instance at a time.
+var multiAttachVolumeTypes = map[string]bool{
+	"io1": true,
+	"io2": true,
+}
+
+func isMultiAttachVolumeType(volumeType string) bool {
+	return multiAttachVolumeTypes[volumeType]
 }
 
 func (plugin *awsPersistentDiskPlugin) NewBuilder(spec *api.Volume, podRef *api.ObjectReference) (volume.Builder, error) {
@@ -83,6 +102,9 @@ func (plugin *awsPersistentDiskPlugin) newBuilderInternal(spec *api.Volume, podU
 		partition = strconv.Itoa(spec.AWSPersistentDisk.Partition)
 	}
 	readOnly := spec.AWSPersistentDisk.ReadOnly
+	volumeType := spec.AWSPersistentDisk.VolumeType
+	encrypted := spec.AWSPersistentDisk.Encrypted
+	kmsKeyID := spec.AWSPersistentDisk.KMSKeyID
 
 	return &awsPersistentDisk{
 		podUID:      podUID,
@@ -91,6 +113,9 @@ func (plugin *awsPersistentDiskPlugin) newBuilderInternal(spec *api.Volume, podU
 		fsType:      fsType,
 		partition:   partition,
 		readOnly:    readOnly,
+		volumeType:  volumeType,
+		encrypted:   encrypted,
+		kmsKeyID:    kmsKeyID,
 		manager:     manager,
 		mounter:     mounter,
 		diskMounter: &awsSafeFormatAndMount{mounter, exec.New()},
@@ -98,6 +123,40 @@ func (plugin *awsPersistentDiskPlugin) newBuilderInternal(spec *api.Volume, podU
 	}, nil
 }
 
+func (plugin *awsPersistentDiskPlugin) NewProvisioner(options volume.VolumeOptions) (volume.Provisioner, error) {
+	// Inject real implementations here, test through the internal function.
+	return plugin.newProvisionerInternal(options, &AWSDiskUtil{})
+}
+
+func (plugin *awsPersistentDiskPlugin) newProvisionerInternal(options volume.VolumeOptions, manager pdManager) (volume.Provisioner, error) {
+	return &awsPersistentDiskProvisioner{
+		awsPersistentDisk: &awsPersistentDisk{
+			manager: manager,
+			plugin:  plugin,
+		},
+		options: options,
+	}, nil
+}
+
+func (plugin *awsPersistentDiskPlugin) NewDeleter(spec *api.PersistentVolume) (volume.Deleter, error) {
+	// Inject real implementations here, test through the internal function.
+	return plugin.newDeleterInternal(spec, &AWSDiskUtil{})
+}
+
+func (plugin *awsPersistentDiskPlugin) newDeleterInternal(spec *api.PersistentVolume, manager pdManager) (volume.Deleter, error) {
+	if spec.Spec.AWSPersistentDisk == nil {
+		return nil, fmt.Errorf("spec.Spec.AWSPersistentDisk is nil")
+	}
+	return &awsPersistentDiskDeleter{
+		awsPersistentDisk: &awsPersistentDisk{
+			pdName:  spec.Spec.AWSPersistentDisk.PDName,
+			manager: manager,
+			plugin:  plugin,
+		},
+		spec: spec,
+	}, nil
+}
+
 func (plugin *awsPersistentDiskPlugin) NewCleaner(volName string, podUID types.UID) (volume.Cleaner, error) {
 	// Inject real implementations here, test through the internal function.
 	return plugin.newCleanerInternal(volName, podUID, &AWSDiskUtil{}, mount.New())
@@ -116,10 +175,20 @@ func (plugin *awsPersistentDiskPlugin) newCleanerInternal(volName string, podUID
 
 // Abstract interface to PD operations.
 type pdManager interface {
-	// Attaches the disk to the kubelet's host machine.
-	AttachAndMountDisk(pd *awsPersistentDisk, globalPDPath string) error
-	// Detaches the disk from the kubelet's host machine.
-	DetachDisk(pd *awsPersistentDisk) error
+	// Acquire records this node's interest in pd and, the first time it is
+	// called for a given pdName, attaches the disk and mounts it at
+	// globalPDPath. Safe to call more than once for the same pdName on the
+	// same node; each call increments a local refcount.
+	Acquire(pd *awsPersistentDisk, globalPDPath string) error
+	// Release drops this node's interest in pd, decrementing the local
+	// refcount. The underlying EC2 DetachVolume call, if any, is performed
+	// asynchronously once the refcount reaches zero.
+	Release(pd *awsPersistentDisk)
+	// Creates a new EBS volume for provisioner, returning its volume ID,
+	// size in GB and the availability zone it was created in.
+	CreateVolume(provisioner *awsPersistentDiskProvisioner) (volumeID string, sizeGB int, zone string, err error)
+	// Deletes the EBS volume backing deleter.
+	DeleteVolume(deleter *awsPersistentDiskDeleter) error
 }
 
 // awsPersistentDisk volumes are disk resources provided by Google Compute Engine
@@ -135,6 +204,14 @@ type awsPersistentDisk struct {
 	partition string
 	// Specifies whether the disk will be attached as read-only.
 	readOnly bool
+	// EBS volume type (e.g. "io1", "io2", "gp2"), optional. Only io1/io2
+	// support attaching the same volume read-only to more than one instance.
+	volumeType string
+	// Whether the pod requires this PD to be encrypted at rest.
+	encrypted bool
+	// KMS key ID from the volume source. Nothing reads it when attaching; the
+	// provisioner takes its key from its own options.
+	kmsKeyID string
 	// Utility interface that provides API calls to the provider to attach/detach disks.
 	manager pdManager
 	// Mounter interface that provides system calls to mount the global path to the pod local path.
@@ -144,11 +221,57 @@ type awsPersistentDisk struct {
 	plugin      *awsPersistentDiskPlugin
 }
 
-func detachDiskLogError(pd *awsPersistentDisk) {
-	err := pd.manager.DetachDisk(pd)
+// awsPersistentDiskProvisioner creates new EBS volumes to satisfy
+// PersistentVolumeClaims bound to a storage class served by this plugin.
+type awsPersistentDiskProvisioner struct {
+	*awsPersistentDisk
+	options volume.VolumeOptions
+}
+
+var _ volume.Provisioner = &awsPersistentDiskProvisioner{}
+
+// Provision creates a new EBS volume and returns the PersistentVolume that
+// describes it.
+func (p *awsPersistentDiskProvisioner) Provision(pv *api.PersistentVolume) (*api.PersistentVolume, error) {
+	volumeID, sizeGB, zone, err := p.manager.CreateVolume(p)
 	if err != nil {
-		glog.Warningf("Failed to detach disk: %v (%v)", pd, err)
+		return nil, err
+	}
+
+	pv.Spec.PersistentVolumeSource = api.PersistentVolumeSource{
+		AWSPersistentDisk: &api.AWSPersistentDiskVolumeSource{
+			PDName:     volumeID,
+			FSType:     "ext4",
+			VolumeType: p.options.Parameters["type"],
+			Encrypted:  p.options.Parameters["encrypted"] == "true",
+			KMSKeyID:   p.options.Parameters["kmsKeyId"],
+		},
+	}
+	pv.Spec.Capacity = api.ResourceList{
+		api.ResourceStorage: resource.MustParse(fmt.Sprintf("%dGi", sizeGB)),
 	}
+	if pv.Labels == nil {
+		pv.Labels = make(map[string]string)
+	}
+	pv.Labels["failure-domain.beta.kubernetes.io/zone"] = zone
+
+	return pv, nil
+}
+
+// awsPersistentDiskDeleter deletes the EBS volume backing a released
+// PersistentVolume.
+type awsPersistentDiskDeleter struct {
+	*awsPersistentDisk
+	spec *api.PersistentVolume
+}
+
+var _ volume.Deleter = &awsPersistentDiskDeleter{}
+
+// Delete removes the EBS volume. It is snapshotted first only when the
+// PersistentVolume carries snapshotBeforeDeleteAnnotation set to "true"; the
+// reclaim policy is not consulted.
+func (d *awsPersistentDiskDeleter) Delete() error {
+	return d.manager.DeleteVolume(d)
 }
 
 // getVolumeProvider returns the AWS Volumes interface
@@ -182,8 +305,26 @@ func (pd *awsPersistentDisk) SetUpAt(dir string) error {
 		return nil
 	}
 
+	// verifyVolumeEncryption is checked on every pod's SetUpAt rather than
+	// inside the attach path, since Acquire below only actually attaches
+	// for the first pod that references pd.pdName; a later pod sharing an
+	// already-attached PD must still have its own encryption requirement
+	// enforced.
+	volumes, err := pd.getVolumeProvider()
+	if err != nil {
+		return err
+	}
+	if err := verifyVolumeEncryption(pd, volumes); err != nil {
+		return err
+	}
+
+	// Acquire only records this node's interest in pd and, if it is the
+	// first local interest, attaches and mounts it at globalPDPath. The
+	// matching release happens in TearDownAt; the actual EC2 DetachVolume
+	// call is reconciled asynchronously by the attach/detach manager so it
+	// can't race with another pod on this node still using the same PD.
 	globalPDPath := makeGlobalPDName(pd.plugin.host, pd.pdName)
-	if err := pd.manager.AttachAndMountDisk(pd, globalPDPath); err != nil {
+	if err := pd.manager.Acquire(pd, globalPDPath); err != nil {
 		return err
 	}
 
@@ -193,8 +334,7 @@ func (pd *awsPersistentDisk) SetUpAt(dir string) error {
 	}
 
 	if err := os.MkdirAll(dir, 0750); err != nil {
-		// TODO: we should really eject the attach/detach out into its own control loop.
-		detachDiskLogError(pd)
+		pd.manager.Release(pd)
 		return err
 	}
 
@@ -223,8 +363,7 @@ func (pd *awsPersistentDisk) SetUpAt(dir string) error {
 			}
 		}
 		os.Remove(dir)
-		// TODO: we should really eject the attach/detach out into its own control loop.
-		detachDiskLogError(pd)
+		pd.manager.Release(pd)
 		return err
 	}
 
@@ -238,6 +377,21 @@ func makeGlobalPDName(host volume.VolumeHost, devName string) string {
 	return path.Join(host.GetPluginDir(awsPersistentDiskPluginName), "mounts", name)
 }
 
+// pdNameFromMountRefs scans refs (as returned by mount.GetMountRefs for a
+// pod's bind mount) for the one pointing at this plugin's global mount
+// directory, and returns the pdName encoded in it. refs also contains any
+// other pods' bind mounts still using the same PD; getPdNameFromGlobalMount
+// rejects those (they resolve outside the global mounts directory) so only
+// the actual global mount ref matches.
+func pdNameFromMountRefs(host volume.VolumeHost, refs []string) (string, error) {
+	for _, ref := range refs {
+		if pdName, err := getPdNameFromGlobalMount(host, ref); err == nil {
+			return pdName, nil
+		}
+	}
+	return "", fmt.Errorf("could not find the global mount path among %v", refs)
+}
+
 func getPdNameFromGlobalMount(host volume.VolumeHost, globalPath string) (string, error) {
 	basePath := path.Join(host.GetPluginDir(awsPersistentDiskPluginName), "mounts")
 	rel, err := filepath.Rel(basePath, globalPath)
@@ -250,7 +404,7 @@ func getPdNameFromGlobalMount(host volume.VolumeHost, globalPath string) (string
 	// Reverse the :// replacement done in makeGlobalPDName
 	name := rel
 	if strings.HasPrefix(name, "aws/") {
-		name = strings.Replace(name, "aws/", "aws://")
+		name = strings.Replace(name, "aws/", "aws://", 1)
 	}
 	return name, nil
 }
@@ -260,14 +414,16 @@ func (pd *awsPersistentDisk) GetPath() string {
 	return pd.plugin.host.GetPodVolumeDir(pd.podUID, util.EscapeQualifiedNameForDisk(name), pd.volName)
 }
 
-// Unmounts the bind mount, and detaches the disk only if the PD
-// resource was the last reference to that disk on the kubelet.
+// Unmounts the bind mount and releases this pod's local interest in the PD;
+// the attach/detach manager decides whether that makes it safe to actually
+// detach.
 func (pd *awsPersistentDisk) TearDown() error {
 	return pd.TearDownAt(pd.GetPath())
 }
 
-// Unmounts the bind mount, and detaches the disk only if the PD
-// resource was the last reference to that disk on the kubelet.
+// Unmounts the bind mount and releases this pod's local interest in the PD;
+// the attach/detach manager decides whether that makes it safe to actually
+// detach.
 func (pd *awsPersistentDisk) TearDownAt(dir string) error {
 	mountpoint, err := mount.IsMountPoint(dir)
 	if err != nil {
@@ -289,20 +445,22 @@ func (pd *awsPersistentDisk) TearDownAt(dir string) error {
 		glog.V(2).Info("Error unmounting dir ", dir, ": ", err)
 		return err
 	}
-	// If len(refs) is 1, then all bind mounts have been removed, and the
-	// remaining reference is the global mount. It is safe to detach.
-	if len(refs) == 1 {
-		// pd.pdName is not initially set for volume-cleaners, so set it here.
-		pd.pdName, err = getPdNameFromGlobalMount(refs[0])
-		if err != nil {
-			glog.V(2).Info("Could not determine pdName from mountpoint ", refs[0], ": ", err)
-			return err
-		}
-		if err := pd.manager.DetachDisk(pd); err != nil {
-			glog.V(2).Info("Error detaching disk ", pd.pdName, ": ", err)
-			return err
-		}
+	// Release our local interest in pd unconditionally, symmetric with the
+	// unconditional Acquire in SetUpAt: with N pods bind-mounting the same
+	// PD (e.g. a ReadOnlyMany multi-attach volume), SetUpAt calls Acquire N
+	// times, so TearDownAt must call Release N times too, or the manager's
+	// refcount never reaches zero and the PD is never detached. Whether
+	// refs still has other pods' bind mounts left is irrelevant here; the
+	// manager's own refcount, not this mount-ref count, decides when it's
+	// safe to actually detach.
+	// pd.pdName is not initially set for volume-cleaners, so set it here.
+	pdName, err := pdNameFromMountRefs(pd.plugin.host, refs)
+	if err != nil {
+		glog.V(2).Info("Could not determine pdName for ", dir, ": ", err)
+		return err
 	}
+	pd.pdName = pdName
+	pd.manager.Release(pd)
 	mountpoint, mntErr := mount.IsMountPoint(dir)
 	if mntErr != nil {
 		glog.Errorf("isMountpoint check failed: %v", mntErr)
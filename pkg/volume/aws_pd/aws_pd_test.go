@@ -0,0 +1,171 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_pd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api/resource"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/volume"
+)
+
+// fakePDManager is a pdManager that records the calls made to it instead of
+// talking to EC2, so Provisioner/Deleter can be exercised without a real
+// cloudprovider.
+type fakePDManager struct {
+	createdFor *awsPersistentDiskProvisioner
+	deletedFor *awsPersistentDiskDeleter
+	volumeID   string
+	sizeGB     int
+	zone       string
+	createErr  error
+	deleteErr  error
+}
+
+var _ pdManager = &fakePDManager{}
+
+func (f *fakePDManager) Acquire(pd *awsPersistentDisk, globalPDPath string) error { return nil }
+func (f *fakePDManager) Release(pd *awsPersistentDisk)                            {}
+
+func (f *fakePDManager) CreateVolume(provisioner *awsPersistentDiskProvisioner) (string, int, string, error) {
+	f.createdFor = provisioner
+	return f.volumeID, f.sizeGB, f.zone, f.createErr
+}
+
+func (f *fakePDManager) DeleteVolume(deleter *awsPersistentDiskDeleter) error {
+	f.deletedFor = deleter
+	return f.deleteErr
+}
+
+func TestGetAccessModes(t *testing.T) {
+	plugin := &awsPersistentDiskPlugin{}
+
+	modes := plugin.GetAccessModes(&api.Volume{
+		VolumeSource: api.VolumeSource{
+			AWSPersistentDisk: &api.AWSPersistentDiskVolumeSource{VolumeType: "gp2"},
+		},
+	})
+	if !reflect.DeepEqual(modes, []api.AccessModeType{api.ReadWriteOnce}) {
+		t.Errorf("gp2 volume: expected only ReadWriteOnce, got %v", modes)
+	}
+
+	modes = plugin.GetAccessModes(&api.Volume{
+		VolumeSource: api.VolumeSource{
+			AWSPersistentDisk: &api.AWSPersistentDiskVolumeSource{VolumeType: "io1"},
+		},
+	})
+	if !reflect.DeepEqual(modes, []api.AccessModeType{api.ReadWriteOnce, api.ReadOnlyMany}) {
+		t.Errorf("io1 volume: expected ReadWriteOnce and ReadOnlyMany, got %v", modes)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	manager := &fakePDManager{volumeID: "vol-1234", sizeGB: 5, zone: "us-east-1a"}
+	plugin := &awsPersistentDiskPlugin{}
+
+	options := volume.VolumeOptions{
+		Capacity: resource.MustParse("5Gi"),
+		Parameters: map[string]string{
+			"type":      "io1",
+			"encrypted": "true",
+			"kmsKeyId":  "arn:aws:kms:us-east-1:1234:key/abcd",
+		},
+	}
+	provisioner, err := plugin.newProvisionerInternal(options, manager)
+	if err != nil {
+		t.Fatalf("newProvisionerInternal failed: %v", err)
+	}
+
+	pv := &api.PersistentVolume{}
+	pv, err = provisioner.Provision(pv)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if manager.createdFor == nil {
+		t.Fatalf("expected CreateVolume to be called")
+	}
+
+	source := pv.Spec.PersistentVolumeSource.AWSPersistentDisk
+	if source == nil {
+		t.Fatalf("expected an AWSPersistentDisk volume source")
+	}
+	if source.PDName != "vol-1234" {
+		t.Errorf("expected PDName vol-1234, got %q", source.PDName)
+	}
+	if !source.Encrypted || source.KMSKeyID != "arn:aws:kms:us-east-1:1234:key/abcd" {
+		t.Errorf("expected encryption params to be carried over, got %+v", source)
+	}
+	if pv.Labels["failure-domain.beta.kubernetes.io/zone"] != "us-east-1a" {
+		t.Errorf("expected zone label to be set, got %+v", pv.Labels)
+	}
+}
+
+// TestPdNameFromMountRefs is a regression test: TearDownAt must recover
+// pdName from GetMountRefs regardless of how many other pods' bind mounts to
+// the same PD are still present, since Release is now called unconditionally
+// rather than only when refs contains a single entry.
+func TestPdNameFromMountRefs(t *testing.T) {
+	host := volume.NewFakeVolumeHost(t.TempDir(), nil, nil)
+	globalPath := makeGlobalPDName(host, "vol-1")
+	refs := []string{
+		"/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~aws-pd/pv-1",
+		globalPath,
+		"/var/lib/kubelet/pods/pod-b/volumes/kubernetes.io~aws-pd/pv-1",
+	}
+
+	pdName, err := pdNameFromMountRefs(host, refs)
+	if err != nil {
+		t.Fatalf("pdNameFromMountRefs failed: %v", err)
+	}
+	if pdName != "vol-1" {
+		t.Errorf("expected pdName vol-1, got %q", pdName)
+	}
+}
+
+func TestPdNameFromMountRefsNoMatch(t *testing.T) {
+	host := volume.NewFakeVolumeHost(t.TempDir(), nil, nil)
+	refs := []string{"/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~aws-pd/pv-1"}
+
+	if _, err := pdNameFromMountRefs(host, refs); err == nil {
+		t.Errorf("expected an error when no ref points at the global mount")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	manager := &fakePDManager{}
+	plugin := &awsPersistentDiskPlugin{}
+
+	spec := &api.PersistentVolume{
+		Spec: api.PersistentVolumeSpec{
+			PersistentVolumeSource: api.PersistentVolumeSource{
+				AWSPersistentDisk: &api.AWSPersistentDiskVolumeSource{PDName: "vol-5678"},
+			},
+		},
+	}
+	deleter, err := plugin.newDeleterInternal(spec, manager)
+	if err != nil {
+		t.Fatalf("newDeleterInternal failed: %v", err)
+	}
+	if err := deleter.Delete(); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if manager.deletedFor == nil {
+		t.Fatalf("expected DeleteVolume to be called")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_pd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/cloudprovider/aws"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/exec"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/mount"
+	"github.com/golang/glog"
+)
+
+// snapshotBeforeDeleteAnnotation, when set to "true" on the PersistentVolume,
+// makes DeleteVolume take an EBS snapshot before deleting the underlying
+// volume, regardless of reclaim policy.
+const snapshotBeforeDeleteAnnotation = "aws-pd.kubernetes.io/snapshot-before-delete"
+
+// AWSDiskUtil implements pdManager by talking to the real AWS API through
+// the cloudprovider/aws Volumes interface.
+type AWSDiskUtil struct{}
+
+var _ pdManager = &AWSDiskUtil{}
+
+// Acquire delegates to the package-level attach/detach manager, which
+// attaches and mounts pd's EBS volume the first time it is requested on
+// this node.
+func (diskUtil *AWSDiskUtil) Acquire(pd *awsPersistentDisk, globalPDPath string) error {
+	return globalAttachDetachManager.acquire(pd, globalPDPath, diskUtil.attachAndMountDisk)
+}
+
+// Release delegates to the package-level attach/detach manager, which
+// detaches pd's EBS volume once this node no longer has any local interest
+// in it. Read-only multi-attach volumes are never detached this way.
+func (diskUtil *AWSDiskUtil) Release(pd *awsPersistentDisk) {
+	globalAttachDetachManager.release(pd, diskUtil.detachDisk)
+}
+
+// attachAndMountDisk attaches pd's EBS volume to this node and mounts it at
+// globalPDPath. verifyVolumeEncryption is not checked here: it only runs once
+// per pdName (the first local acquire), but a pod's encryption requirement
+// must be enforced on every attach attempt, so the caller (SetUpAt) checks it
+// before ever calling Acquire.
+func (diskUtil *AWSDiskUtil) attachAndMountDisk(pd *awsPersistentDisk, globalPDPath string) error {
+	volumes, err := pd.getVolumeProvider()
+	if err != nil {
+		return err
+	}
+	instanceID, err := volumes.InstanceID()
+	if err != nil {
+		return err
+	}
+
+	// io1/io2 volumes may be attached read-only to more than one instance;
+	// ask for that explicitly so the exclusive-attach check in the cloud
+	// provider doesn't reject an attachment that's already held elsewhere.
+	multiAttach := pd.readOnly && isMultiAttachVolumeType(pd.volumeType)
+	devicePath, err := volumes.AttachDisk(instanceID, pd.pdName, pd.readOnly, multiAttach)
+	if err != nil {
+		return err
+	}
+
+	options := []string{}
+	if pd.readOnly {
+		options = append(options, "ro")
+	}
+	mounter, ok := pd.diskMounter.(*awsSafeFormatAndMount)
+	if !ok {
+		return fmt.Errorf("Failed to cast %v to awsSafeFormatAndMount", pd.diskMounter)
+	}
+	if err := mounter.FormatAndMount(devicePath, globalPDPath, pd.fsType, options); err != nil {
+		return fmt.Errorf("Failed to format and mount device from (%q) to (%q) with fstype (%q): %v", devicePath, globalPDPath, pd.fsType, err)
+	}
+	return nil
+}
+
+// verifyVolumeEncryption refuses to attach a plaintext volume where the pod
+// requires encryption. It is intentionally one-directional: encrypted is a
+// new field, so any pre-existing PersistentVolume spec that references an
+// already-encrypted EBS volume without setting it is the normal
+// backward-compatible case, not a policy violation, and must still attach.
+func verifyVolumeEncryption(pd *awsPersistentDisk, volumes aws_cloud.Volumes) error {
+	info, err := volumes.DescribeVolume(pd.pdName)
+	if err != nil {
+		return fmt.Errorf("Error describing volume %q: %v", pd.pdName, err)
+	}
+	if pd.encrypted && !info.Encrypted {
+		// TODO: record a proper Event once VolumeHost exposes an event
+		// recorder to volume plugins (it doesn't yet at this vintage); for
+		// now this at least fails the attach loudly instead of silently
+		// mounting a plaintext volume where encryption was required.
+		return fmt.Errorf("Refusing to attach volume %q: pod requires an encrypted volume but it is not encrypted", pd.pdName)
+	}
+	return nil
+}
+
+// detachDisk detaches pd's EBS volume from this node.
+func (diskUtil *AWSDiskUtil) detachDisk(pd *awsPersistentDisk) error {
+	volumes, err := pd.getVolumeProvider()
+	if err != nil {
+		return err
+	}
+	instanceID, err := volumes.InstanceID()
+	if err != nil {
+		return err
+	}
+	if _, err := volumes.DetachDisk(instanceID, pd.pdName); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateVolume creates a new EBS volume for provisioner's storage class
+// options, waits for it to become available, and tags it with the owning
+// cluster and PersistentVolume name.
+func (diskUtil *AWSDiskUtil) CreateVolume(provisioner *awsPersistentDiskProvisioner) (volumeID string, sizeGB int, zone string, err error) {
+	volumes, err := provisioner.getVolumeProvider()
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	capacity := provisioner.options.Capacity
+	requestBytes := capacity.Value()
+	sizeGB = int(util.RoundUpSize(requestBytes, 1024*1024*1024))
+
+	volumeOptions := &aws_cloud.VolumeOptions{
+		CapacityGB: sizeGB,
+		Tags:       provisioner.options.CloudTags,
+		VolumeType: provisioner.options.Parameters["type"],
+		IOPSPerGB:  provisioner.options.Parameters["iopsPerGB"],
+		Encrypted:  provisioner.options.Parameters["encrypted"] == "true",
+		KmsKeyId:   provisioner.options.Parameters["kmsKeyId"],
+	}
+
+	name, zone, err := volumes.CreateVolume(volumeOptions)
+	if err != nil {
+		glog.V(2).Infof("Error creating EBS volume: %v", err)
+		return "", 0, "", err
+	}
+	glog.V(2).Infof("Created EBS volume %s in zone %s", name, zone)
+	return name, sizeGB, zone, nil
+}
+
+// DeleteVolume deletes deleter's EBS volume, taking a snapshot first when
+// the PersistentVolume's snapshotBeforeDeleteAnnotation is "true". The
+// reclaim policy is not consulted.
+func (diskUtil *AWSDiskUtil) DeleteVolume(deleter *awsPersistentDiskDeleter) error {
+	volumes, err := deleter.getVolumeProvider()
+	if err != nil {
+		return err
+	}
+
+	if deleter.spec.Annotations[snapshotBeforeDeleteAnnotation] == "true" {
+		snapshotID, err := volumes.CreateSnapshot(deleter.pdName)
+		if err != nil {
+			return fmt.Errorf("Error creating snapshot of %q before delete: %v", deleter.pdName, err)
+		}
+		glog.V(2).Infof("Created snapshot %s of volume %s before deleting it", snapshotID, deleter.pdName)
+	}
+
+	if err := volumes.DeleteVolume(deleter.pdName); err != nil {
+		glog.V(2).Infof("Error deleting EBS volume %s: %v", deleter.pdName, err)
+		return err
+	}
+	return nil
+}
+
+// awsSafeFormatAndMount wraps a mount.Interface so the underlying device is
+// formatted before the first mount, and left alone on subsequent mounts.
+type awsSafeFormatAndMount struct {
+	mount.Interface
+	runner exec.Interface
+}
+
+// FormatAndMount formats device with fsType if it is not already formatted,
+// then mounts it at target.
+func (mounter *awsSafeFormatAndMount) FormatAndMount(device, target, fsType string, options []string) error {
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	existingFormat, err := mounter.getDiskFormat(device)
+	if err != nil {
+		return err
+	}
+
+	if existingFormat == "" {
+		args := []string{device}
+		if _, err := mounter.runner.Command("mkfs."+fsType, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to mkfs.%s on %q: %v", fsType, device, err)
+		}
+	} else if existingFormat != fsType {
+		return fmt.Errorf("Device %q already formatted with %q, cannot mount as %q", device, existingFormat, fsType)
+	}
+
+	flags := uintptr(0)
+	for _, option := range options {
+		if option == "ro" {
+			flags |= mount.FlagReadOnly
+		}
+	}
+	return mounter.Mount(device, target, fsType, flags, "")
+}
+
+// getDiskFormat returns the filesystem on device, or "" if it is
+// unformatted.
+func (mounter *awsSafeFormatAndMount) getDiskFormat(device string) (string, error) {
+	args := []string{"-p", "-s", "TYPE", "-o", "value", device}
+	out, err := mounter.runner.Command("blkid", args...).CombinedOutput()
+	if err != nil {
+		// blkid returns exit code 2 when the device has no recognized
+		// filesystem; treat that as "unformatted" rather than an error.
+		if exitErr, ok := err.(exec.ExitError); ok && exitErr.ExitStatus() == 2 {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_pd
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/cloudprovider/aws"
+)
+
+type fakeVolumes struct {
+	aws_cloud.Volumes
+	info *aws_cloud.VolumeInfo
+}
+
+func (f *fakeVolumes) DescribeVolume(pdName string) (*aws_cloud.VolumeInfo, error) {
+	return f.info, nil
+}
+
+func TestVerifyVolumeEncryption(t *testing.T) {
+	cases := []struct {
+		name      string
+		encrypted bool
+		volume    bool
+		wantErr   bool
+	}{
+		{"pod wants encrypted, volume is encrypted", true, true, false},
+		{"pod wants plaintext, volume is plaintext", false, false, false},
+		{"pod wants encrypted, volume is plaintext", true, false, true},
+		{"pod wants plaintext, pre-existing volume already encrypted", false, true, false},
+	}
+
+	for _, c := range cases {
+		pd := &awsPersistentDisk{pdName: "vol-1", encrypted: c.encrypted}
+		volumes := &fakeVolumes{info: &aws_cloud.VolumeInfo{Encrypted: c.volume}}
+		err := verifyVolumeEncryption(pd, volumes)
+		if c.wantErr && err == nil {
+			t.Errorf("%s: expected an error, got nil", c.name)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%s: expected no error, got %v", c.name, err)
+		}
+	}
+}